@@ -0,0 +1,123 @@
+/*
+Copyright Digital Asset Holdings, LLC 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// Identity is the resolved caller of a Broadcast or Deliver stream, used
+// for downstream filters and audit logging.
+type Identity struct {
+	ClientID string
+	Cert     string
+}
+
+// IdentityProvider resolves a bearer token carried in gRPC metadata to an
+// Identity.
+type IdentityProvider interface {
+	Identify(token string) (Identity, error)
+}
+
+// fileIdentityProvider is an IdentityProvider backed by a JSON file that
+// maps bearer tokens to client identities, each optionally pinned to a PEM
+// certificate path.
+type fileIdentityProvider struct {
+	byToken map[string]Identity
+}
+
+type identityRecord struct {
+	Token    string
+	ClientID string
+	Cert     string
+}
+
+// loadIdentityProvider reads the JSON identity file referenced by
+// flags.authConfig.
+func loadIdentityProvider(path string) (*fileIdentityProvider, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth config %s: %s", path, err)
+	}
+	var records []identityRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse auth config %s: %s", path, err)
+	}
+
+	p := &fileIdentityProvider{byToken: make(map[string]Identity, len(records))}
+	for _, r := range records {
+		p.byToken[r.Token] = Identity{ClientID: r.ClientID, Cert: r.Cert}
+	}
+	return p, nil
+}
+
+func (p *fileIdentityProvider) Identify(token string) (Identity, error) {
+	id, ok := p.byToken[token]
+	if !ok {
+		return Identity{}, fmt.Errorf("unknown bearer token")
+	}
+	return id, nil
+}
+
+const bearerMetadataKey = "authorization"
+
+type identityContextKey struct{}
+
+// identityFromContext returns the Identity attached by authenticateStream,
+// if any.
+func identityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityContextKey{}).(Identity)
+	return id, ok
+}
+
+// authenticateStream extracts a bearer token from ctx's incoming gRPC
+// metadata, resolves it through provider, and returns a child context
+// carrying the resolved Identity for downstream filters and audit logs. A
+// nil provider disables authentication entirely, which is how existing
+// deployments without an authConfig keep working.
+func authenticateStream(ctx context.Context, provider IdentityProvider) (context.Context, error) {
+	if provider == nil {
+		return ctx, nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, grpcUnauthenticated("no gRPC metadata on stream")
+	}
+	tokens := md[bearerMetadataKey]
+	if len(tokens) == 0 {
+		return nil, grpcUnauthenticated("missing %s metadata", bearerMetadataKey)
+	}
+
+	id, err := provider.Identify(tokens[0])
+	if err != nil {
+		return nil, grpcUnauthenticated("%s", err)
+	}
+
+	return context.WithValue(ctx, identityContextKey{}, id), nil
+}
+
+func grpcUnauthenticated(format string, args ...interface{}) error {
+	return grpc.Errorf(codes.Unauthenticated, format, args...)
+}
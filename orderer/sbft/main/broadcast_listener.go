@@ -0,0 +1,82 @@
+/*
+Copyright Digital Asset Holdings, LLC 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	ab "github.com/hyperledger/fabric/protos/orderer"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+// broadcastOnlyServer exposes Broadcast and rejects Deliver, so it can be
+// registered on a listener dedicated to transaction submission.
+type broadcastOnlyServer struct {
+	*backend
+}
+
+func (s broadcastOnlyServer) Deliver(srv ab.AtomicBroadcast_DeliverServer) error {
+	return grpc.Errorf(codes.Unimplemented, "Deliver is not served on the broadcast-only listener")
+}
+
+// deliverOnlyServer exposes Deliver and rejects Broadcast, the counterpart
+// to broadcastOnlyServer for the main listener once broadcastAddr is set.
+type deliverOnlyServer struct {
+	*backend
+}
+
+func (s deliverOnlyServer) Broadcast(srv ab.AtomicBroadcast_BroadcastServer) error {
+	return grpc.Errorf(codes.Unimplemented, "Broadcast is not served on the deliver listener")
+}
+
+// rateLimitInterceptor bounds the broadcast-only listener to maxInFlight
+// concurrent streams and ratePerSecond accepted streams per second,
+// rejecting anything beyond that with codes.ResourceExhausted.
+func rateLimitInterceptor(maxInFlight int, ratePerSecond float64) grpc.StreamServerInterceptor {
+	inFlight := make(chan struct{}, maxInFlight)
+	limiter := rate.NewLimiter(rate.Limit(ratePerSecond), maxInFlight)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !limiter.Allow() {
+			return grpc.Errorf(codes.ResourceExhausted, "broadcast rate limit exceeded")
+		}
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			return grpc.Errorf(codes.ResourceExhausted, "too many in-flight broadcast streams")
+		}
+		defer func() { <-inFlight }()
+
+		return handler(srv, ss)
+	}
+}
+
+// newTLSServerOptions builds the grpc.ServerOption for a listener's own
+// cert/key pair, or nil options if either is unset.
+func newTLSServerOptions(certFile, keyFile string) ([]grpc.ServerOption, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS credentials from %s/%s: %s", certFile, keyFile, err)
+	}
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
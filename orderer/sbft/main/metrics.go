@@ -0,0 +1,121 @@
+/*
+Copyright Digital Asset Holdings, LLC 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/hyperledger/fabric/common/metrics"
+	"github.com/hyperledger/fabric/common/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects the counters, gauges and histograms exported by an SBFT
+// peer, modeled on the metrics registered by orderer/common/server.
+type Metrics struct {
+	BroadcastReceived  metrics.Counter
+	BroadcastEnqueued  metrics.Counter
+	BroadcastRejected  metrics.Counter
+	DeliverBlocksSent  metrics.Counter
+	DeliverStreamsOpen metrics.Gauge
+
+	// BatchSize is the only consensus-side gauge wired up so far: SBFT
+	// round/view-change tracking doesn't exist yet in this peer, so there
+	// is nothing real to source ViewNumber/ActiveViewChanges/
+	// ConsensusRoundLatency collectors from. Add them back alongside the
+	// consensus round loop that can actually set them.
+	BatchSize metrics.Gauge
+}
+
+// NewMetrics registers the SBFT metric collectors against provider.
+func NewMetrics(provider metrics.Provider) *Metrics {
+	return &Metrics{
+		BroadcastReceived: provider.NewCounter(metrics.CounterOpts{
+			Namespace: "sbft",
+			Subsystem: "broadcast",
+			Name:      "received",
+			Help:      "The number of envelopes received on the Broadcast API.",
+		}),
+		BroadcastEnqueued: provider.NewCounter(metrics.CounterOpts{
+			Namespace: "sbft",
+			Subsystem: "broadcast",
+			Name:      "enqueued",
+			Help:      "The number of envelopes enqueued for ordering.",
+		}),
+		BroadcastRejected: provider.NewCounter(metrics.CounterOpts{
+			Namespace: "sbft",
+			Subsystem: "broadcast",
+			Name:      "rejected",
+			Help:      "The number of envelopes rejected before ordering.",
+		}),
+		DeliverBlocksSent: provider.NewCounter(metrics.CounterOpts{
+			Namespace: "sbft",
+			Subsystem: "deliver",
+			Name:      "blocks_sent",
+			Help:      "The number of blocks sent to Deliver clients.",
+		}),
+		DeliverStreamsOpen: provider.NewGauge(metrics.GaugeOpts{
+			Namespace: "sbft",
+			Subsystem: "deliver",
+			Name:      "streams_open",
+			Help:      "The number of currently open Deliver streams.",
+		}),
+		BatchSize: provider.NewGauge(metrics.GaugeOpts{
+			Namespace: "sbft",
+			Subsystem: "consensus",
+			Name:      "batch_size",
+			Help:      "The number of envelopes in the most recently cut batch.",
+		}),
+	}
+}
+
+var (
+	metricsOnce    sync.Once
+	processMetrics *Metrics
+)
+
+// sharedMetrics returns the process-wide Metrics instance, registering its
+// collectors against the default Prometheus registry exactly once. Every
+// serve() call in the process (as happens when the test suite runs several
+// SBFT instances in parallel) must reuse this instance rather than
+// registering the same collector names a second time, which the
+// Prometheus client panics on.
+func sharedMetrics() *Metrics {
+	metricsOnce.Do(func() {
+		processMetrics = NewMetrics(&prometheus.Provider{})
+	})
+	return processMetrics
+}
+
+// serveMetrics starts a /metrics HTTP endpoint bound to addr. It returns
+// immediately; the listener runs in the background for the lifetime of the
+// process.
+func serveMetrics(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go http.Serve(lis, mux)
+	mainLogger.Infof("SBFT metrics listening on %s", addr)
+	return nil
+}
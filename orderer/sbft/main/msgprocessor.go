@@ -0,0 +1,126 @@
+/*
+Copyright Digital Asset Holdings, LLC 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	cb "github.com/hyperledger/fabric/protos/common"
+)
+
+// Classification distinguishes the handling an envelope's payload requires
+// once it has passed the Filters pipeline, mirroring
+// orderer/common/msgprocessor's NormalMsg/ConfigMsg/ConfigUpdateMsg split.
+type Classification int
+
+const (
+	NormalMsg Classification = iota
+	ConfigMsg
+	ConfigUpdateMsg
+)
+
+// ClassifyMsg inspects a channel header's type and returns how the
+// associated envelope should be routed.
+func ClassifyMsg(chdr *cb.ChannelHeader) Classification {
+	switch cb.HeaderType(chdr.Type) {
+	case cb.HeaderType_CONFIG, cb.HeaderType_ORDERER_TRANSACTION:
+		return ConfigMsg
+	case cb.HeaderType_CONFIG_UPDATE:
+		return ConfigUpdateMsg
+	default:
+		return NormalMsg
+	}
+}
+
+// Filter is a single broadcast-path validation check, applied to an
+// envelope before it is handed to the ordering engine.
+type Filter interface {
+	Apply(envelope *cb.Envelope) error
+}
+
+// Filters is an ordered pipeline of Filter. Apply stops and returns the
+// first error encountered.
+type Filters []Filter
+
+func (fs Filters) Apply(envelope *cb.Envelope) error {
+	for _, f := range fs {
+		if err := f.Apply(envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SizeFilter rejects envelopes whose marshaled payload exceeds maxBytes.
+type SizeFilter struct {
+	maxBytes int
+}
+
+func (f SizeFilter) Apply(envelope *cb.Envelope) error {
+	if f.maxBytes > 0 && len(envelope.Payload) > f.maxBytes {
+		return fmt.Errorf("envelope payload of %d bytes exceeds the %d byte limit", len(envelope.Payload), f.maxBytes)
+	}
+	return nil
+}
+
+// SigFilter rejects envelopes that carry no signature. It does not verify
+// the signature against an identity; that belongs to a future, fuller
+// msgprocessor pipeline.
+type SigFilter struct{}
+
+func (f SigFilter) Apply(envelope *cb.Envelope) error {
+	if len(envelope.Signature) == 0 {
+		return fmt.Errorf("envelope is missing a required signature")
+	}
+	return nil
+}
+
+// ExpirationRejectionFilter rejects envelopes whose channel header
+// timestamp is more than maxAge in the past. Timestamps in the future and
+// envelopes without a timestamp are accepted.
+type ExpirationRejectionFilter struct {
+	maxAge time.Duration
+}
+
+func (f ExpirationRejectionFilter) Apply(envelope *cb.Envelope) error {
+	if f.maxAge <= 0 {
+		return nil
+	}
+	_, chdr, err := channelID(envelope)
+	if err != nil {
+		return err
+	}
+	if chdr.Timestamp == nil {
+		return nil
+	}
+	ts := time.Unix(chdr.Timestamp.Seconds, int64(chdr.Timestamp.Nanos))
+	if time.Since(ts) > f.maxAge {
+		return fmt.Errorf("envelope timestamp %s is older than the %s expiration window", ts, f.maxAge)
+	}
+	return nil
+}
+
+// defaultFilters returns the standard broadcast-path pipeline for an SBFT
+// peer configured with the given size limit.
+func defaultFilters(maxBytes int) Filters {
+	return Filters{
+		SizeFilter{maxBytes: maxBytes},
+		SigFilter{},
+		ExpirationRejectionFilter{maxAge: 24 * time.Hour},
+	}
+}
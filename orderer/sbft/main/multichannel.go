@@ -0,0 +1,99 @@
+/*
+Copyright Digital Asset Holdings, LLC 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	cb "github.com/hyperledger/fabric/protos/common"
+)
+
+// multichannelRegistrar owns the system channel and every application
+// channel bootstrapped from it, modeled on the real
+// orderer/common/multichannel.Registrar. The system channel ID is fixed at
+// construction time; application channels are created on demand from a
+// CONFIG envelope broadcast to them.
+type multichannelRegistrar struct {
+	systemChannelID string
+	metrics         *Metrics
+
+	mutex  sync.Mutex
+	chains map[string]*chainSupport
+}
+
+func newMultichannelRegistrar(systemChannelID string, systemGenesis *cb.Block) *multichannelRegistrar {
+	r := &multichannelRegistrar{
+		systemChannelID: systemChannelID,
+		chains:          make(map[string]*chainSupport),
+	}
+	r.chains[systemChannelID] = newChainSupport(systemChannelID, systemGenesis)
+	return r
+}
+
+// GetChain returns the chainSupport for channelID, if it has been
+// bootstrapped.
+func (r *multichannelRegistrar) GetChain(channelID string) (*chainSupport, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cs, ok := r.chains[channelID]
+	return cs, ok
+}
+
+// newChannel bootstraps a new application channel from a CONFIG envelope,
+// using the envelope itself as the channel's genesis transaction. It is a
+// no-op if the channel already exists.
+func (r *multichannelRegistrar) newChannel(channelID string, configEnvelope *cb.Envelope) (*chainSupport, error) {
+	data, err := proto.Marshal(configEnvelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config envelope: %s", err)
+	}
+
+	genesis := &cb.Block{
+		Header: &cb.BlockHeader{Number: 0},
+		Data:   &cb.BlockData{Data: [][]byte{data}},
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if cs, ok := r.chains[channelID]; ok {
+		return cs, nil
+	}
+	cs := newChainSupport(channelID, genesis)
+	cs.metrics = r.metrics
+	r.chains[channelID] = cs
+	return cs, nil
+}
+
+// channelID extracts the destination channel of envelope from its
+// marshaled common.Payload/common.ChannelHeader, the same layering used
+// throughout the rest of Fabric's broadcast path.
+func channelID(envelope *cb.Envelope) (string, *cb.ChannelHeader, error) {
+	payload := &cb.Payload{}
+	if err := proto.Unmarshal(envelope.Payload, payload); err != nil {
+		return "", nil, fmt.Errorf("failed to unmarshal payload: %s", err)
+	}
+	if payload.Header == nil {
+		return "", nil, fmt.Errorf("envelope has no header")
+	}
+	chdr := &cb.ChannelHeader{}
+	if err := proto.Unmarshal(payload.Header.ChannelHeader, chdr); err != nil {
+		return "", nil, fmt.Errorf("failed to unmarshal channel header: %s", err)
+	}
+	return chdr.ChannelId, chdr, nil
+}
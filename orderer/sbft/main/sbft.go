@@ -0,0 +1,488 @@
+/*
+Copyright Digital Asset Holdings, LLC 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/orderer/common/bootstrap/provisional"
+	cb "github.com/hyperledger/fabric/protos/common"
+	ab "github.com/hyperledger/fabric/protos/orderer"
+	"github.com/op/go-logging"
+	"google.golang.org/grpc"
+)
+
+var mainLogger = logging.MustGetLogger("sbft/main")
+
+// flags collects the on-disk and network configuration for a single SBFT
+// orderer process. A zero value is only useful for tests that set the
+// fields they need directly.
+type flags struct {
+	init        string
+	genesisFile string
+	listenAddr  string
+	grpcAddr    string
+	metricsAddr string
+	certFile    string
+	keyFile     string
+	dataDir     string
+
+	// broadcastAddr, when set, moves the Broadcast service onto its own
+	// listener with independent TLS credentials and back-pressure, leaving
+	// only Deliver on grpcAddr.
+	broadcastAddr          string
+	broadcastCertFile      string
+	broadcastKeyFile       string
+	broadcastMaxInFlight   int
+	broadcastRatePerSecond float64
+
+	// maxMessageBytes bounds the size of a single broadcast envelope's
+	// marshaled payload; the signature is not counted. Zero means no limit.
+	maxMessageBytes int
+
+	// authConfig, when set, names a JSON file mapping bearer tokens to
+	// client identities; streams without a valid token are rejected.
+	authConfig string
+}
+
+// sbftConfig is the membership and batching configuration loaded from the
+// file referenced by flags.init.
+type sbftConfig struct {
+	N                  int
+	F                  int
+	BatchDurationNsec  int64
+	BatchSizeBytes     int
+	RequestTimeoutNsec int64
+	Peers              []sbftPeerConfig
+}
+
+type sbftPeerConfig struct {
+	ID      uint64
+	Address string
+	Cert    string
+}
+
+// loadConfig reads and parses the config file referenced by c.init.
+func loadConfig(c flags) (*sbftConfig, error) {
+	raw, err := ioutil.ReadFile(c.init)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %s", c.init, err)
+	}
+	cfg := &sbftConfig{}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %s", c.init, err)
+	}
+	return cfg, nil
+}
+
+// initInstance validates the config referenced by c.init, prepares the data
+// directory and writes out the genesis block for the system channel.
+func initInstance(c flags) error {
+	if _, err := loadConfig(c); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data dir %s: %s", c.dataDir, err)
+	}
+
+	genesisBlock := newGenesisBlock(provisional.TestChainID)
+	genesisBytes, err := proto.Marshal(genesisBlock)
+	if err != nil {
+		return fmt.Errorf("failed to marshal genesis block: %s", err)
+	}
+	if err := ioutil.WriteFile(c.genesisFile, genesisBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write genesis file %s: %s", c.genesisFile, err)
+	}
+	return nil
+}
+
+// serve brings up the gRPC Broadcast/Deliver endpoint and blocks until the
+// listener fails.
+func serve(c flags) error {
+	genesisBytes, err := ioutil.ReadFile(c.genesisFile)
+	if err != nil {
+		return fmt.Errorf("failed to read genesis file %s: %s", c.genesisFile, err)
+	}
+	genesisBlock := &cb.Block{}
+	if err := proto.Unmarshal(genesisBytes, genesisBlock); err != nil {
+		return fmt.Errorf("failed to unmarshal genesis block: %s", err)
+	}
+
+	metrics := sharedMetrics()
+	registrar := newMultichannelRegistrar(provisional.TestChainID, genesisBlock)
+	registrar.metrics = metrics
+	if cs, ok := registrar.GetChain(provisional.TestChainID); ok {
+		cs.metrics = metrics
+	}
+	b := newBackend(registrar)
+	b.metrics = metrics
+	b.filters = defaultFilters(c.maxMessageBytes)
+	if c.authConfig != "" {
+		identities, err := loadIdentityProvider(c.authConfig)
+		if err != nil {
+			return err
+		}
+		b.identities = identities
+	}
+
+	if c.metricsAddr != "" {
+		if err := serveMetrics(c.metricsAddr); err != nil {
+			return fmt.Errorf("failed to start metrics listener on %s: %s", c.metricsAddr, err)
+		}
+	}
+
+	if c.broadcastAddr != "" {
+		if err := serveBroadcastOnly(c, b); err != nil {
+			return err
+		}
+	}
+
+	lis, err := net.Listen("tcp", c.grpcAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", c.grpcAddr, err)
+	}
+
+	grpcServer := grpc.NewServer()
+	if c.broadcastAddr != "" {
+		ab.RegisterAtomicBroadcastServer(grpcServer, deliverOnlyServer{b})
+		mainLogger.Infof("SBFT peer listening for Deliver on %s", c.grpcAddr)
+	} else {
+		ab.RegisterAtomicBroadcastServer(grpcServer, b)
+		mainLogger.Infof("SBFT peer listening for Broadcast/Deliver on %s", c.grpcAddr)
+	}
+	return grpcServer.Serve(lis)
+}
+
+// serveBroadcastOnly starts the dedicated Broadcast listener and returns
+// once it is up; the listener itself runs in the background for the
+// lifetime of the process.
+func serveBroadcastOnly(c flags, b *backend) error {
+	opts, err := newTLSServerOptions(c.broadcastCertFile, c.broadcastKeyFile)
+	if err != nil {
+		return err
+	}
+
+	maxInFlight := c.broadcastMaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = 100
+	}
+	ratePerSecond := c.broadcastRatePerSecond
+	if ratePerSecond <= 0 {
+		ratePerSecond = float64(maxInFlight)
+	}
+	opts = append(opts, grpc.StreamInterceptor(rateLimitInterceptor(maxInFlight, ratePerSecond)))
+
+	lis, err := net.Listen("tcp", c.broadcastAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %s", c.broadcastAddr, err)
+	}
+
+	broadcastServer := grpc.NewServer(opts...)
+	ab.RegisterAtomicBroadcastServer(broadcastServer, broadcastOnlyServer{b})
+
+	mainLogger.Infof("SBFT peer listening for Broadcast on %s", c.broadcastAddr)
+	go func() {
+		if err := broadcastServer.Serve(lis); err != nil {
+			mainLogger.Errorf("Broadcast-only listener on %s stopped: %s", c.broadcastAddr, err)
+		}
+	}()
+	return nil
+}
+
+// newGenesisBlock builds the single, empty founding block of a chain.
+func newGenesisBlock(chainID string) *cb.Block {
+	return &cb.Block{
+		Header: &cb.BlockHeader{
+			Number:       0,
+			PreviousHash: nil,
+		},
+		Data: &cb.BlockData{},
+	}
+}
+
+// backend implements ab.AtomicBroadcastServer over an in-memory set of
+// chains, keyed by channel ID.
+type backend struct {
+	registrar  *multichannelRegistrar
+	metrics    *Metrics
+	filters    Filters
+	identities IdentityProvider
+}
+
+func newBackend(registrar *multichannelRegistrar) *backend {
+	return &backend{registrar: registrar}
+}
+
+// Broadcast implements ab.AtomicBroadcastServer. Each envelope received is
+// routed, by the channel ID in its header, to the chain it targets, and cut
+// into its own block there. A CONFIG envelope addressed to a channel that
+// does not yet exist bootstraps that channel.
+func (b *backend) Broadcast(srv ab.AtomicBroadcast_BroadcastServer) error {
+	ctx, err := authenticateStream(srv.Context(), b.identities)
+	if err != nil {
+		return err
+	}
+	id, _ := identityFromContext(ctx)
+
+	for {
+		envelope, err := srv.Recv()
+		if err != nil {
+			return err
+		}
+		if b.metrics != nil {
+			b.metrics.BroadcastReceived.Add(1)
+		}
+
+		if err := b.filters.Apply(envelope); err != nil {
+			mainLogger.Warningf("Rejecting envelope at the filter pipeline: %s", err)
+			if b.metrics != nil {
+				b.metrics.BroadcastRejected.Add(1)
+			}
+			if err := srv.Send(&ab.BroadcastResponse{Status: cb.Status_BAD_REQUEST}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		chID, chdr, err := channelID(envelope)
+		if err != nil {
+			if b.metrics != nil {
+				b.metrics.BroadcastRejected.Add(1)
+			}
+			if err := srv.Send(&ab.BroadcastResponse{Status: cb.Status_BAD_REQUEST}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		cls := ClassifyMsg(chdr)
+
+		cs, ok := b.registrar.GetChain(chID)
+		if !ok {
+			if cls != ConfigMsg {
+				if b.metrics != nil {
+					b.metrics.BroadcastRejected.Add(1)
+				}
+				if err := srv.Send(&ab.BroadcastResponse{Status: cb.Status_NOT_FOUND}); err != nil {
+					return err
+				}
+				continue
+			}
+			cs, err = b.registrar.newChannel(chID, envelope)
+			if err != nil {
+				if b.metrics != nil {
+					b.metrics.BroadcastRejected.Add(1)
+				}
+				if err := srv.Send(&ab.BroadcastResponse{Status: cb.Status_INTERNAL_SERVER_ERROR}); err != nil {
+					return err
+				}
+				continue
+			}
+			mainLogger.Infof("AUDIT client=%q action=create-channel channel=%q", id.ClientID, chID)
+			if err := srv.Send(&ab.BroadcastResponse{Status: cb.Status_SUCCESS}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch cls {
+		case ConfigMsg, ConfigUpdateMsg:
+			cs.orderConfig(envelope)
+			mainLogger.Infof("AUDIT client=%q action=config channel=%q block=%d", id.ClientID, chID, cs.lastConfigBlockNumber())
+		default:
+			cs.order(envelope)
+		}
+		if b.metrics != nil {
+			b.metrics.BroadcastEnqueued.Add(1)
+		}
+		mainLogger.Infof("AUDIT client=%q action=broadcast channel=%q", id.ClientID, chID)
+		if err := srv.Send(&ab.BroadcastResponse{Status: cb.Status_SUCCESS}); err != nil {
+			return err
+		}
+	}
+}
+
+// Deliver implements ab.AtomicBroadcastServer. It streams blocks from the
+// chain named by the client's SeekInfo, starting at the requested position.
+func (b *backend) Deliver(srv ab.AtomicBroadcast_DeliverServer) error {
+	ctx, err := authenticateStream(srv.Context(), b.identities)
+	if err != nil {
+		return err
+	}
+	id, _ := identityFromContext(ctx)
+
+	seek, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+
+	cs, ok := b.registrar.GetChain(seek.ChainID)
+	if !ok {
+		return srv.Send(&ab.DeliverResponse{
+			Type: &ab.DeliverResponse_Status{Status: cb.Status_NOT_FOUND},
+		})
+	}
+
+	if b.metrics != nil {
+		b.metrics.DeliverStreamsOpen.Add(1)
+		defer b.metrics.DeliverStreamsOpen.Add(-1)
+	}
+
+	updates, cancel := cs.subscribe()
+	defer cancel()
+
+	next := uint64(0)
+	if seek.Start.GetNewest() != nil {
+		next = cs.blockCount()
+	} else if specified := seek.Start.GetSpecified(); specified != nil {
+		next = specified.Number
+	}
+
+	for {
+		block := cs.blockAt(next)
+		if block == nil {
+			block = <-updates
+		}
+		if err := srv.Send(&ab.DeliverResponse{
+			Type: &ab.DeliverResponse_Block{Block: block},
+		}); err != nil {
+			return err
+		}
+		if b.metrics != nil {
+			b.metrics.DeliverBlocksSent.Add(1)
+		}
+		mainLogger.Infof("AUDIT client=%q action=deliver channel=%q block=%d", id.ClientID, seek.ChainID, block.Header.Number)
+		next++
+	}
+}
+
+// chainSupport owns the append-only block log for a single channel and
+// fans out newly-cut blocks to active Deliver subscribers.
+type chainSupport struct {
+	chainID string
+	metrics *Metrics
+
+	mutex           sync.Mutex
+	blocks          []*cb.Block
+	subscribers     map[chan *cb.Block]struct{}
+	lastConfigBlock uint64
+}
+
+func newChainSupport(chainID string, genesis *cb.Block) *chainSupport {
+	return &chainSupport{
+		chainID:     chainID,
+		blocks:      []*cb.Block{genesis},
+		subscribers: make(map[chan *cb.Block]struct{}),
+	}
+}
+
+// order cuts a new block containing envelope and notifies subscribers.
+func (cs *chainSupport) order(envelope *cb.Envelope) {
+	cs.cutBlock(envelope, false)
+}
+
+// orderConfig cuts a new block containing a CONFIG or CONFIG_UPDATE
+// envelope, the same as order, but additionally records the block as the
+// chain's most recent configuration block so that config envelopes are
+// genuinely distinguished from ordinary transactions rather than merely
+// classified on the way in.
+func (cs *chainSupport) orderConfig(envelope *cb.Envelope) {
+	cs.cutBlock(envelope, true)
+}
+
+// cutBlock appends a new block containing envelope to the chain and
+// notifies subscribers. isConfig marks the block as a configuration block,
+// updating lastConfigBlock under the same lock as the append.
+func (cs *chainSupport) cutBlock(envelope *cb.Envelope, isConfig bool) {
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		mainLogger.Errorf("failed to marshal envelope: %s", err)
+		return
+	}
+
+	cs.mutex.Lock()
+	number := uint64(len(cs.blocks))
+	block := &cb.Block{
+		Header: &cb.BlockHeader{
+			Number: number,
+		},
+		Data: &cb.BlockData{Data: [][]byte{data}},
+	}
+	cs.blocks = append(cs.blocks, block)
+	if isConfig {
+		cs.lastConfigBlock = number
+	}
+	subs := make([]chan *cb.Block, 0, len(cs.subscribers))
+	for ch := range cs.subscribers {
+		subs = append(subs, ch)
+	}
+	cs.mutex.Unlock()
+
+	if cs.metrics != nil {
+		cs.metrics.BatchSize.Set(float64(len(block.Data.Data)))
+	}
+
+	for _, ch := range subs {
+		ch <- block
+	}
+}
+
+// lastConfigBlockNumber returns the number of the most recent configuration
+// block cut on this chain, mirroring the LAST_CONFIG index that real Fabric
+// blocks carry in their metadata.
+func (cs *chainSupport) lastConfigBlockNumber() uint64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.lastConfigBlock
+}
+
+func (cs *chainSupport) blockAt(number uint64) *cb.Block {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if number >= uint64(len(cs.blocks)) {
+		return nil
+	}
+	return cs.blocks[number]
+}
+
+// blockCount returns the number of blocks currently on the chain,
+// including the genesis block.
+func (cs *chainSupport) blockCount() uint64 {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return uint64(len(cs.blocks))
+}
+
+func (cs *chainSupport) subscribe() (chan *cb.Block, func()) {
+	ch := make(chan *cb.Block, 16)
+	cs.mutex.Lock()
+	cs.subscribers[ch] = struct{}{}
+	cs.mutex.Unlock()
+
+	return ch, func() {
+		cs.mutex.Lock()
+		delete(cs.subscribers, ch)
+		cs.mutex.Unlock()
+	}
+}
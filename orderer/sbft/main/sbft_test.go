@@ -17,9 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,6 +34,7 @@ import (
 	"github.com/op/go-logging"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 var logger = logging.MustGetLogger("sbft_test")
@@ -40,6 +45,12 @@ var SEND byte = 1
 var NEEDED_UPDATES = 2
 var NEEDED_SENT = 1
 
+func skipInShortMode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping SBFT integration test in short mode")
+	}
+}
+
 func TestSbftPeer(t *testing.T) {
 	t.Parallel()
 	skipInShortMode(t)
@@ -58,6 +69,7 @@ func TestSbftPeer(t *testing.T) {
 		genesisFile: fmt.Sprintf("%s_%s", tempDir, "genesis"),
 		listenAddr:  ":6101",
 		grpcAddr:    ":7101",
+		metricsAddr: ":7102",
 		certFile:    "testdata/cert1.pem",
 		keyFile:     "testdata/key.pem",
 		dataDir:     tempDir}
@@ -93,6 +105,60 @@ func TestSbftPeer(t *testing.T) {
 	go broadcastSender(t, resultch, errorch, client)
 
 	checkResults(t, resultch, errorch)
+
+	assertMetricsIncremented(t, "http://127.0.0.1:7102/metrics")
+}
+
+// assertMetricsIncremented scrapes the /metrics endpoint after a
+// broadcast/deliver round-trip and checks that the counters we expect to
+// have moved actually carry a positive sample value, not merely that their
+// name appears in the (always-present) HELP/TYPE exposition lines.
+func assertMetricsIncremented(t *testing.T, url string) {
+	logger.Info("Scraping metrics endpoint.")
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Errorf("Failed to scrape metrics endpoint: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read metrics response: %s", err)
+		return
+	}
+	scraped := string(body)
+
+	for _, name := range []string{
+		"sbft_broadcast_received",
+		"sbft_broadcast_enqueued",
+		"sbft_deliver_blocks_sent",
+	} {
+		if v := metricSampleValue(t, scraped, name); v <= 0 {
+			t.Errorf("Expected metric %s to be > 0 after a broadcast/deliver round-trip, got %v", name, v)
+		}
+	}
+}
+
+// metricSampleValue finds the Prometheus text-exposition sample line for
+// an unlabeled metric named name and returns its value.
+func metricSampleValue(t *testing.T, scraped, name string) float64 {
+	for _, line := range strings.Split(scraped, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != name {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("Failed to parse sample value for metric %s: %s", name, err)
+		}
+		return v
+	}
+	t.Fatalf("Metric %s not found in scrape output: %s", name, scraped)
+	return 0
 }
 
 func checkResults(t *testing.T, resultch chan byte, errorch chan error) {
@@ -135,7 +201,7 @@ func updateReceiver(t *testing.T, resultch chan byte, errorch chan error, client
 	}
 	err = dstream.Send(&ab.SeekInfo{
 		ChainID:  provisional.TestChainID,
-		Start:    &ab.SeekPosition{Type: &ab.SeekPosition_Newest{Newest: &ab.SeekNewest{}}},
+		Start:    &ab.SeekPosition{Type: &ab.SeekPosition_Oldest{Oldest: &ab.SeekOldest{}}},
 		Stop:     &ab.SeekPosition{Type: &ab.SeekPosition_Specified{Specified: &ab.SeekSpecified{Number: ^uint64(0)}}},
 		Behavior: ab.SeekInfo_BLOCK_UNTIL_READY,
 	})
@@ -176,13 +242,518 @@ func broadcastSender(t *testing.T, resultch chan byte, errorch chan error, clien
 		return
 	}
 	bs := []byte{0, 1, 2, 3}
-	pl := &cb.Payload{Data: bs}
-	mpl, err := proto.Marshal(pl)
-	if err != nil {
-		panic("Failed to marshal payload.")
-	}
-	bstream.Send(&cb.Envelope{Payload: mpl})
+	bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, bs))
 	logger.Infof("{Broadcast Sender} Broadcast sent: %v", bs)
 	logger.Info("{Broadcast Sender} Exiting...")
 	resultch <- SEND
 }
+
+// makeEnvelope builds an envelope addressed to chainID, the same layering
+// (Envelope -> Payload -> ChannelHeader) used by the rest of Fabric's
+// broadcast path.
+func makeEnvelope(chainID string, headerType cb.HeaderType, data []byte) *cb.Envelope {
+	chdr, err := proto.Marshal(&cb.ChannelHeader{
+		Type:      int32(headerType),
+		ChannelId: chainID,
+	})
+	if err != nil {
+		panic("Failed to marshal channel header.")
+	}
+	payload, err := proto.Marshal(&cb.Payload{
+		Header: &cb.Header{ChannelHeader: chdr},
+		Data:   data,
+	})
+	if err != nil {
+		panic("Failed to marshal payload.")
+	}
+	return &cb.Envelope{Payload: payload, Signature: []byte("test-signature")}
+}
+
+// TestSbftMultiChannel verifies that a single SBFT peer can bootstrap an
+// application channel alongside the system channel, over the same
+// Broadcast connection, and keep the two channels' Deliver streams
+// independent.
+func TestSbftMultiChannel(t *testing.T) {
+	t.Parallel()
+	skipInShortMode(t)
+	tempDir, err := ioutil.TempDir("", "sbft_multichannel_test")
+	if err != nil {
+		panic("Failed to create a temporary directory")
+	}
+	os.RemoveAll(tempDir)
+	defer func() {
+		os.RemoveAll(tempDir)
+	}()
+	c := flags{init: "testdata/config.json",
+		genesisFile: fmt.Sprintf("%s_%s", tempDir, "genesis"),
+		listenAddr:  ":6103",
+		grpcAddr:    ":7103",
+		metricsAddr: ":7104",
+		certFile:    "testdata/cert1.pem",
+		keyFile:     "testdata/key.pem",
+		dataDir:     tempDir}
+
+	if err := initInstance(c); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	go serve(c)
+	<-time.After(5 * time.Second)
+
+	clientconn, err := grpc.Dial(":7103", grpc.WithBlock(), grpc.WithTimeout(4*time.Second), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect to GRPC: %s", err)
+	}
+	client := ab.NewAtomicBroadcastClient(clientconn)
+
+	const secondChannel = "testchannelid2"
+
+	bstream, err := client.Broadcast(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get broadcast stream: %s", err)
+	}
+
+	if err := bstream.Send(makeEnvelope(secondChannel, cb.HeaderType_CONFIG, nil)); err != nil {
+		t.Fatalf("Failed to send CONFIG envelope: %s", err)
+	}
+	resp, err := bstream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive CONFIG broadcast response: %s", err)
+	}
+	if resp.Status != cb.Status_SUCCESS {
+		t.Fatalf("Expected channel creation to succeed, got status %v", resp.Status)
+	}
+
+	systemSeek, err := client.Deliver(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get Deliver stream for system channel: %s", err)
+	}
+	seekOldest(t, systemSeek, provisional.TestChainID)
+
+	secondSeek, err := client.Deliver(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get Deliver stream for second channel: %s", err)
+	}
+	seekOldest(t, secondSeek, secondChannel)
+
+	systemPayload := []byte{10, 20, 30}
+	secondPayload := []byte{40, 50, 60}
+	if err := bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, systemPayload)); err != nil {
+		t.Fatalf("Failed to broadcast to system channel: %s", err)
+	}
+	if err := bstream.Send(makeEnvelope(secondChannel, cb.HeaderType_ENDORSER_TRANSACTION, secondPayload)); err != nil {
+		t.Fatalf("Failed to broadcast to second channel: %s", err)
+	}
+
+	if got := lastTxPayload(t, systemSeek); string(got) != string(systemPayload) {
+		t.Errorf("System channel delivered %v, want %v", got, systemPayload)
+	}
+	if got := lastTxPayload(t, secondSeek); string(got) != string(secondPayload) {
+		t.Errorf("Second channel delivered %v, want %v", got, secondPayload)
+	}
+
+	t.Run("SeekNewest starts at the current tip, not genesis", func(t *testing.T) {
+		newestSeek, err := client.Deliver(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to get Deliver stream: %s", err)
+		}
+		seekNewest(t, newestSeek, provisional.TestChainID)
+		// Give the server a moment to process the seek and compute the
+		// current tip before we cut the block it must skip straight to.
+		<-time.After(1 * time.Second)
+
+		thirdPayload := []byte{70, 80, 90}
+		if err := bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, thirdPayload)); err != nil {
+			t.Fatalf("Failed to broadcast to system channel: %s", err)
+		}
+
+		m, err := newestSeek.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive block: %s", err)
+		}
+		b := m.Type.(*ab.DeliverResponse_Block)
+		if b.Block.Header.Number != 2 {
+			t.Fatalf("Expected SeekNewest to skip straight to block 2, got block %d", b.Block.Header.Number)
+		}
+		if got := txPayload(t, b.Block); string(got) != string(thirdPayload) {
+			t.Errorf("SeekNewest delivered %v, want %v", got, thirdPayload)
+		}
+	})
+}
+
+// seekNewest sends a SeekInfo requesting blocks starting at the chain's
+// current tip, excluding anything already on the ledger.
+func seekNewest(t *testing.T, stream ab.AtomicBroadcast_DeliverClient, chainID string) {
+	err := stream.Send(&ab.SeekInfo{
+		ChainID:  chainID,
+		Start:    &ab.SeekPosition{Type: &ab.SeekPosition_Newest{Newest: &ab.SeekNewest{}}},
+		Stop:     &ab.SeekPosition{Type: &ab.SeekPosition_Specified{Specified: &ab.SeekSpecified{Number: ^uint64(0)}}},
+		Behavior: ab.SeekInfo_BLOCK_UNTIL_READY,
+	})
+	if err != nil {
+		t.Fatalf("Failed to seek on channel %s: %s", chainID, err)
+	}
+}
+
+// txPayload unmarshals block's single transaction and returns its raw data.
+func txPayload(t *testing.T, block *cb.Block) []byte {
+	if len(block.Data.Data) == 0 {
+		t.Fatalf("Block %d has no transactions", block.Header.Number)
+	}
+	e := &cb.Envelope{}
+	if err := proto.Unmarshal(block.Data.Data[0], e); err != nil {
+		t.Fatalf("Failed to unmarshal envelope: %s", err)
+	}
+	pl := &cb.Payload{}
+	if err := proto.Unmarshal(e.Payload, pl); err != nil {
+		t.Fatalf("Failed to unmarshal payload: %s", err)
+	}
+	return pl.Data
+}
+
+func seekOldest(t *testing.T, stream ab.AtomicBroadcast_DeliverClient, chainID string) {
+	err := stream.Send(&ab.SeekInfo{
+		ChainID:  chainID,
+		Start:    &ab.SeekPosition{Type: &ab.SeekPosition_Oldest{Oldest: &ab.SeekOldest{}}},
+		Stop:     &ab.SeekPosition{Type: &ab.SeekPosition_Specified{Specified: &ab.SeekSpecified{Number: ^uint64(0)}}},
+		Behavior: ab.SeekInfo_BLOCK_UNTIL_READY,
+	})
+	if err != nil {
+		t.Fatalf("Failed to seek on channel %s: %s", chainID, err)
+	}
+}
+
+// lastTxPayload reads the genesis block followed by the next cut block on
+// stream and returns the raw data of that block's single transaction.
+func lastTxPayload(t *testing.T, stream ab.AtomicBroadcast_DeliverClient) []byte {
+	for i := 0; i < 2; i++ {
+		m, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive block: %s", err)
+		}
+		b := m.Type.(*ab.DeliverResponse_Block)
+		if len(b.Block.Data.Data) == 0 {
+			continue
+		}
+		e := &cb.Envelope{}
+		pl := &cb.Payload{}
+		if err := proto.Unmarshal(b.Block.Data.Data[0], e); err != nil {
+			t.Fatalf("Failed to unmarshal envelope: %s", err)
+		}
+		if err := proto.Unmarshal(e.Payload, pl); err != nil {
+			t.Fatalf("Failed to unmarshal payload: %s", err)
+		}
+		if pl.Header != nil {
+			chdr := &cb.ChannelHeader{}
+			if err := proto.Unmarshal(pl.Header.ChannelHeader, chdr); err == nil && cb.HeaderType(chdr.Type) == cb.HeaderType_ENDORSER_TRANSACTION {
+				return pl.Data
+			}
+		}
+	}
+	return nil
+}
+
+// TestSbftBroadcastOnlyListener verifies that Broadcast and Deliver can be
+// split across two independent listeners, and that the broadcast-only
+// listener rejects Deliver.
+func TestSbftBroadcastOnlyListener(t *testing.T) {
+	t.Parallel()
+	skipInShortMode(t)
+	tempDir, err := ioutil.TempDir("", "sbft_broadcast_listener_test")
+	if err != nil {
+		panic("Failed to create a temporary directory")
+	}
+	os.RemoveAll(tempDir)
+	defer func() {
+		os.RemoveAll(tempDir)
+	}()
+	c := flags{init: "testdata/config.json",
+		genesisFile:          fmt.Sprintf("%s_%s", tempDir, "genesis"),
+		listenAddr:           ":6105",
+		grpcAddr:             ":7105",
+		metricsAddr:          ":7106",
+		certFile:             "testdata/cert1.pem",
+		keyFile:              "testdata/key.pem",
+		dataDir:              tempDir,
+		broadcastAddr:        ":7107",
+		broadcastMaxInFlight: 10,
+	}
+
+	if err := initInstance(c); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	go serve(c)
+	<-time.After(5 * time.Second)
+
+	broadcastConn, err := grpc.Dial(":7107", grpc.WithBlock(), grpc.WithTimeout(4*time.Second), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect to broadcast-only listener: %s", err)
+	}
+	deliverConn, err := grpc.Dial(":7105", grpc.WithBlock(), grpc.WithTimeout(4*time.Second), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect to deliver listener: %s", err)
+	}
+
+	broadcastClient := ab.NewAtomicBroadcastClient(broadcastConn)
+	deliverClient := ab.NewAtomicBroadcastClient(deliverConn)
+
+	dstream, err := deliverClient.Deliver(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get Deliver stream: %s", err)
+	}
+	seekOldest(t, dstream, provisional.TestChainID)
+
+	bstream, err := broadcastClient.Broadcast(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get broadcast stream: %s", err)
+	}
+	payload := []byte{7, 8, 9}
+	if err := bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, payload)); err != nil {
+		t.Fatalf("Failed to broadcast: %s", err)
+	}
+	if got := lastTxPayload(t, dstream); string(got) != string(payload) {
+		t.Errorf("Delivered %v, want %v", got, payload)
+	}
+
+	rejected, err := broadcastClient.Deliver(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open Deliver stream on broadcast-only listener: %s", err)
+	}
+	if err := rejected.Send(&ab.SeekInfo{ChainID: provisional.TestChainID}); err != nil {
+		t.Fatalf("Failed to send on rejected Deliver stream: %s", err)
+	}
+	if _, err := rejected.Recv(); err == nil {
+		t.Errorf("Expected Deliver on the broadcast-only listener to be rejected")
+	}
+}
+
+// TestSbftMsgProcessorPipeline exercises the filter pipeline that guards
+// broadcast before an envelope reaches the ordering engine.
+func TestSbftMsgProcessorPipeline(t *testing.T) {
+	t.Parallel()
+	skipInShortMode(t)
+	tempDir, err := ioutil.TempDir("", "sbft_msgprocessor_test")
+	if err != nil {
+		panic("Failed to create a temporary directory")
+	}
+	os.RemoveAll(tempDir)
+	defer func() {
+		os.RemoveAll(tempDir)
+	}()
+	c := flags{init: "testdata/config.json",
+		genesisFile:     fmt.Sprintf("%s_%s", tempDir, "genesis"),
+		listenAddr:      ":6109",
+		grpcAddr:        ":7109",
+		metricsAddr:     ":7110",
+		certFile:        "testdata/cert1.pem",
+		keyFile:         "testdata/key.pem",
+		dataDir:         tempDir,
+		maxMessageBytes: 64,
+	}
+
+	if err := initInstance(c); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	go serve(c)
+	<-time.After(5 * time.Second)
+
+	clientconn, err := grpc.Dial(":7109", grpc.WithBlock(), grpc.WithTimeout(4*time.Second), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect to GRPC: %s", err)
+	}
+	client := ab.NewAtomicBroadcastClient(clientconn)
+
+	bstream, err := client.Broadcast(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to get broadcast stream: %s", err)
+	}
+
+	t.Run("oversized envelope is rejected", func(t *testing.T) {
+		oversized := makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, make([]byte, 256))
+		if err := bstream.Send(oversized); err != nil {
+			t.Fatalf("Failed to send oversized envelope: %s", err)
+		}
+		resp, err := bstream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive broadcast response: %s", err)
+		}
+		if resp.Status != cb.Status_BAD_REQUEST {
+			t.Errorf("Expected an oversized envelope to get BAD_REQUEST, got %v", resp.Status)
+		}
+	})
+
+	t.Run("envelope missing a signature is dropped", func(t *testing.T) {
+		unsigned := makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, []byte{1})
+		unsigned.Signature = nil
+		if err := bstream.Send(unsigned); err != nil {
+			t.Fatalf("Failed to send unsigned envelope: %s", err)
+		}
+		resp, err := bstream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive broadcast response: %s", err)
+		}
+		if resp.Status != cb.Status_BAD_REQUEST {
+			t.Errorf("Expected an unsigned envelope to get BAD_REQUEST, got %v", resp.Status)
+		}
+	})
+
+	t.Run("config-update produces a new configuration block", func(t *testing.T) {
+		const configChannel = "testchannelid3"
+		if err := bstream.Send(makeEnvelope(configChannel, cb.HeaderType_CONFIG, nil)); err != nil {
+			t.Fatalf("Failed to bootstrap config channel: %s", err)
+		}
+		if resp, err := bstream.Recv(); err != nil || resp.Status != cb.Status_SUCCESS {
+			t.Fatalf("Failed to bootstrap config channel: resp=%v err=%s", resp, err)
+		}
+
+		dstream, err := client.Deliver(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to get Deliver stream: %s", err)
+		}
+		seekOldest(t, dstream, configChannel)
+
+		if err := bstream.Send(makeEnvelope(configChannel, cb.HeaderType_CONFIG_UPDATE, []byte("new config"))); err != nil {
+			t.Fatalf("Failed to send config update: %s", err)
+		}
+		if resp, err := bstream.Recv(); err != nil || resp.Status != cb.Status_SUCCESS {
+			t.Fatalf("Failed to broadcast config update: resp=%v err=%s", resp, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			m, err := dstream.Recv()
+			if err != nil {
+				t.Fatalf("Failed to receive block: %s", err)
+			}
+			b := m.Type.(*ab.DeliverResponse_Block)
+			if len(b.Block.Data.Data) == 0 {
+				continue
+			}
+			e := &cb.Envelope{}
+			pl := &cb.Payload{}
+			if err := proto.Unmarshal(b.Block.Data.Data[0], e); err != nil {
+				t.Fatalf("Failed to unmarshal envelope: %s", err)
+			}
+			if err := proto.Unmarshal(e.Payload, pl); err != nil {
+				t.Fatalf("Failed to unmarshal payload: %s", err)
+			}
+			chdr := &cb.ChannelHeader{}
+			if err := proto.Unmarshal(pl.Header.ChannelHeader, chdr); err != nil {
+				t.Fatalf("Failed to unmarshal channel header: %s", err)
+			}
+			if ClassifyMsg(chdr) != ConfigUpdateMsg {
+				continue
+			}
+			if string(pl.Data) != "new config" {
+				t.Errorf("Expected the config block to carry the config-update payload, got %v", pl.Data)
+			}
+			return
+		}
+		t.Errorf("Never observed a configuration block for the config update")
+	})
+}
+
+// TestSbftClientAuth exercises the metadata-based client authentication
+// added in front of Broadcast and Deliver.
+//
+// This test deliberately does not call t.Parallel(): it swaps the
+// process-wide go-logging backend via logging.SetBackend to capture the
+// audit log line, and every other test in this file calls t.Parallel() as
+// its first statement. Go only resumes paused parallel tests once every
+// serial test in the package has finished, so, wherever it is defined, this
+// test runs to completion (installing a fresh stderr backend via its defer)
+// before any other test's serve() goroutine can log against the swapped
+// backend. Adding t.Parallel() here would break that ordering and make the
+// audit-log assertion (or other tests' log output) flaky.
+func TestSbftClientAuth(t *testing.T) {
+	skipInShortMode(t)
+	tempDir, err := ioutil.TempDir("", "sbft_auth_test")
+	if err != nil {
+		panic("Failed to create a temporary directory")
+	}
+	os.RemoveAll(tempDir)
+	defer func() {
+		os.RemoveAll(tempDir)
+	}()
+	c := flags{init: "testdata/config.json",
+		genesisFile: fmt.Sprintf("%s_%s", tempDir, "genesis"),
+		listenAddr:  ":6111",
+		grpcAddr:    ":7111",
+		metricsAddr: ":7112",
+		certFile:    "testdata/cert1.pem",
+		keyFile:     "testdata/key.pem",
+		dataDir:     tempDir,
+		authConfig:  "testdata/auth.json",
+	}
+
+	if err := initInstance(c); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	var auditLog bytes.Buffer
+	logBackend := logging.NewLogBackend(&auditLog, "", 0)
+	logging.SetBackend(logBackend)
+	defer logging.SetBackend(logging.NewLogBackend(os.Stderr, "", 0))
+
+	go serve(c)
+	<-time.After(5 * time.Second)
+
+	clientconn, err := grpc.Dial(":7111", grpc.WithBlock(), grpc.WithTimeout(4*time.Second), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Failed to connect to GRPC: %s", err)
+	}
+	client := ab.NewAtomicBroadcastClient(clientconn)
+
+	authedCtx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(bearerMetadataKey, "test-client-token"))
+
+	t.Run("valid metadata succeeds", func(t *testing.T) {
+		bstream, err := client.Broadcast(authedCtx)
+		if err != nil {
+			t.Fatalf("Failed to get broadcast stream: %s", err)
+		}
+		if err := bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, []byte{1, 2, 3})); err != nil {
+			t.Fatalf("Failed to send envelope: %s", err)
+		}
+		resp, err := bstream.Recv()
+		if err != nil {
+			t.Fatalf("Failed to receive broadcast response: %s", err)
+		}
+		if resp.Status != cb.Status_SUCCESS {
+			t.Errorf("Expected a broadcast with valid metadata to succeed, got %v", resp.Status)
+		}
+	})
+
+	t.Run("missing metadata is rejected", func(t *testing.T) {
+		bstream, err := client.Broadcast(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to get broadcast stream: %s", err)
+		}
+		if err := bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, []byte{4, 5, 6})); err != nil {
+			t.Fatalf("Failed to send envelope: %s", err)
+		}
+		if _, err := bstream.Recv(); err == nil {
+			t.Errorf("Expected a broadcast without metadata to be rejected")
+		}
+	})
+
+	t.Run("invalid metadata is rejected", func(t *testing.T) {
+		badCtx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(bearerMetadataKey, "not-a-real-token"))
+		bstream, err := client.Broadcast(badCtx)
+		if err != nil {
+			t.Fatalf("Failed to get broadcast stream: %s", err)
+		}
+		if err := bstream.Send(makeEnvelope(provisional.TestChainID, cb.HeaderType_ENDORSER_TRANSACTION, []byte{7, 8, 9})); err != nil {
+			t.Fatalf("Failed to send envelope: %s", err)
+		}
+		if _, err := bstream.Recv(); err == nil {
+			t.Errorf("Expected a broadcast with an invalid token to be rejected")
+		}
+	})
+
+	t.Run("identity appears in the audit log", func(t *testing.T) {
+		if !strings.Contains(auditLog.String(), `client="test-client"`) {
+			t.Errorf("Expected the audit log to contain the authenticated client's identity, got: %s", auditLog.String())
+		}
+	})
+}